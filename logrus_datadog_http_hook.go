@@ -2,11 +2,21 @@ package hook
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -17,25 +27,124 @@ type DataDogOptions struct {
 	APIKey string
 	// Minimum log level at which to send logs to DataDog
 	MinLevel logrus.Level
-	// Base URL of the DataDog API
+	// Base URL of the DataDog API. Takes precedence over Site when set.
 	BaseURL string
 	// Base Path of the DataDog API
 	BasePath string
+	// DataDog site to send logs to, used to resolve BaseURL when it isn't
+	// set explicitly. Defaults to SiteEU, matching the historical default.
+	Site Site
 	// Service name to send to DataDog
 	Service string
 	// Source name to send to DataDog
 	Source string
 	// The host tag to send to DataDog
 	Host string
+	// Tags to attach to every log entry, sent as the comma-separated
+	// "ddtags" field (e.g. {"env": "prod"} becomes "env:prod").
+	Tags map[string]string
+	// Attributes merged into every log entry. An attribute is skipped for
+	// an entry that already sets the same key via logrus fields.
+	GlobalAttributes map[string]interface{}
+	// Maximum number of entries to send in a single batch. Capped at 1000,
+	// the limit enforced by the DataDog HTTP intake.
+	BatchMaxSize int
+	// Maximum size in bytes of a single batch. Capped at 5MB, the limit
+	// enforced by the DataDog HTTP intake.
+	BatchMaxBytes int
+	// Maximum amount of time an entry can sit in the buffer before it is
+	// flushed, even if BatchMaxSize/BatchMaxBytes haven't been reached.
+	FlushInterval time.Duration
+	// Size of the channel used to buffer entries between Fire and the
+	// background flusher goroutine.
+	BufferSize int
+	// HTTPClient to use for sending logs. If set, Timeout, Proxy and
+	// TLSConfig below are ignored.
+	HTTPClient *http.Client
+	// Timeout for a single send request. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Proxy URL to route requests through. Defaults to respecting the
+	// standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables.
+	Proxy string
+	// TLS configuration used by the default HTTP client's transport.
+	TLSConfig *tls.Config
+	// Policy applied when Fire produces entries faster than they can be
+	// buffered. Defaults to OverflowBlock.
+	OverflowPolicy OverflowPolicy
+	// Called whenever an entry is dropped or a batch fails to send. entry is
+	// nil for batch-level send failures and intake-limit drops, since a batch
+	// mixes entries from possibly many Fire calls, and for entries evicted by
+	// OverflowDropOldest.
+	OnError func(error, *logrus.Entry)
 }
 
+// OverflowPolicy controls what Fire does when the buffer between it and the
+// background flusher is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Fire block until the buffer has room. Guarantees
+	// no log is lost but can stall the calling goroutine.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest evicts the oldest buffered entry to make room for
+	// the new one.
+	OverflowDropOldest
+	// OverflowDropNewest drops the entry Fire was just asked to send.
+	OverflowDropNewest
+)
+
+// Site identifies a DataDog region, used to resolve the HTTP intake host.
+type Site string
+
+const (
+	SiteUS1 Site = "datadoghq.com"
+	SiteUS3 Site = "us3.datadoghq.com"
+	SiteUS5 Site = "us5.datadoghq.com"
+	SiteEU  Site = "datadoghq.eu"
+	SiteGov Site = "ddog-gov.com"
+)
+
 type DataDogHook struct {
-	APIKey    string
-	MinLevel  logrus.Level
-	URL       *url.URL
-	Service   string
-	Host      string
-	Formatter logrus.Formatter
+	APIKey     string
+	MinLevel   logrus.Level
+	URL        *url.URL
+	Service    string
+	Host       string
+	Formatter  logrus.Formatter
+	HTTPClient *http.Client
+
+	batchMaxSize  int
+	batchMaxBytes int
+	flushInterval time.Duration
+
+	overflowPolicy OverflowPolicy
+	onError        func(error, *logrus.Entry)
+
+	buffer    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	sent    uint64
+	dropped uint64
+	failed  uint64
+	retried uint64
+}
+
+// Stats is a snapshot of a DataDogHook's counters, returned by Stats().
+type Stats struct {
+	// Sent is the number of entries successfully delivered to DataDog.
+	Sent uint64
+	// Dropped is the number of entries discarded by the overflow policy
+	// because the buffer was full, plus entries left out of a batch for
+	// exceeding the DataDog intake limits.
+	Dropped uint64
+	// Failed is the number of entries that could not be delivered: entries
+	// over the per-entry size limit, and entries in batches that failed to
+	// send, whether after exhausting retries or on a non-retriable error.
+	Failed uint64
+	// Retried is the number of retry attempts made across all sends.
+	Retried uint64
 }
 
 const (
@@ -43,15 +152,42 @@ const (
 	contentType  = "application/json"
 	// Maximum content size for a single log: 256kb
 	maxEntryByte = 256 * 1024
-	maxRetry     = 3
+	// Maximum number of entries DataDog accepts in a single intake request.
+	maxBatchSize = 1000
+	// Maximum payload size DataDog accepts in a single intake request: 5MB.
+	maxBatchBytes = 5 * 1024 * 1024
+	maxRetry      = 3
+
+	defaultMaxIdleConnsPerHost = 10
+
+	// Payloads larger than this are gzip-compressed before being sent.
+	gzipThreshold = 1024
+
+	// Exponential backoff parameters used between retries.
+	retryBaseDelay = 200 * time.Millisecond
+	retryFactor    = 2
+	retryMaxDelay  = 30 * time.Second
 )
 
 var (
 	ErrMissingAPIKey = errors.New("missing DataDog API key")
+	// ErrBufferFull is returned by Fire when the buffer is full and the
+	// configured OverflowPolicy drops the entry instead of blocking.
+	ErrBufferFull = errors.New("datadog hook: buffer full, entry dropped")
+	// ErrEntryTooLarge is returned by Fire when the formatted entry exceeds
+	// maxEntryByte. It is dropped rather than truncated, since truncating
+	// arbitrary JSON at a byte offset produces invalid JSON and would
+	// corrupt the whole batch it ends up in.
+	ErrEntryTooLarge = errors.New("datadog hook: entry exceeds maximum size, dropped")
 
-	defaultMinLevel = logrus.InfoLevel
-	defaultBaseURL  = "http://http-intake.logs.datadoghq.eu"
-	defaultBasePath = "/v1/input"
+	defaultMinLevel      = logrus.InfoLevel
+	defaultSite          = SiteEU
+	defaultBasePath      = "/v1/input"
+	defaultBatchMaxSize  = 250
+	defaultBatchMaxBytes = 2 * 1024 * 1024
+	defaultFlushInterval = 5 * time.Second
+	defaultBufferSize    = 1000
+	defaultTimeout       = 5 * time.Second
 )
 
 func NewDataDogHook(options DataDogOptions) (*DataDogHook, error) {
@@ -65,15 +201,34 @@ func NewDataDogHook(options DataDogOptions) (*DataDogHook, error) {
 		return nil, err
 	}
 
+	httpClient, err := buildHTTPClient(options)
+	if err != nil {
+		return nil, err
+	}
+
 	hook := &DataDogHook{
-		APIKey:    options.APIKey,
-		MinLevel:  options.MinLevel,
-		URL:       url,
-		Service:   options.Service,
-		Host:      options.Host,
-		Formatter: &logrus.JSONFormatter{},
+		APIKey:     options.APIKey,
+		MinLevel:   options.MinLevel,
+		URL:        url,
+		Service:    options.Service,
+		Host:       options.Host,
+		Formatter:  newDataDogFormatter(options.Tags, options.GlobalAttributes),
+		HTTPClient: httpClient,
+
+		batchMaxSize:  options.BatchMaxSize,
+		batchMaxBytes: options.BatchMaxBytes,
+		flushInterval: options.FlushInterval,
+
+		overflowPolicy: options.OverflowPolicy,
+		onError:        options.OnError,
+
+		buffer: make(chan []byte, options.BufferSize),
+		done:   make(chan struct{}),
 	}
 
+	hook.wg.Add(1)
+	go hook.loop()
+
 	return hook, nil
 }
 
@@ -81,44 +236,398 @@ func (dh *DataDogHook) Levels() []logrus.Level {
 	return logrus.AllLevels[:dh.MinLevel+1]
 }
 
+// Fire formats the entry and enqueues it for the background flusher. It
+// returns as soon as the entry has been buffered; the actual HTTP call
+// happens asynchronously, either once the batch fills up or on the next
+// flush tick. When the buffer is full, behavior is governed by
+// OverflowPolicy: Fire either blocks, drops the oldest buffered entry, or
+// drops this entry.
 func (dh *DataDogHook) Fire(entry *logrus.Entry) error {
 	log, err := dh.Formatter.Format(entry)
 	if err != nil {
 		return err
 	}
 
-	return dh.send(log)
+	if len(log) > maxEntryByte {
+		atomic.AddUint64(&dh.failed, 1)
+		dh.reportError(ErrEntryTooLarge, entry)
+		return ErrEntryTooLarge
+	}
+
+	if dh.overflowPolicy == OverflowBlock {
+		dh.buffer <- log
+		return nil
+	}
+
+	select {
+	case dh.buffer <- log:
+		return nil
+	default:
+	}
+
+	if dh.overflowPolicy == OverflowDropOldest {
+		select {
+		case <-dh.buffer:
+			// The evicted entry was already formatted and enqueued by an
+			// earlier Fire call, which has long since returned, so there's
+			// no *logrus.Entry left to pass to reportError.
+			atomic.AddUint64(&dh.dropped, 1)
+			dh.reportError(ErrBufferFull, nil)
+		default:
+		}
+		select {
+		case dh.buffer <- log:
+			return nil
+		default:
+		}
+	}
+
+	atomic.AddUint64(&dh.dropped, 1)
+	dh.reportError(ErrBufferFull, entry)
+	return ErrBufferFull
 }
 
-func (dh *DataDogHook) send(log []byte) error {
-	if len(log) > maxEntryByte {
-		log = log[:maxEntryByte]
+// reportError invokes OnError, if configured. The callback runs synchronously
+// on the calling goroutine (Fire or the background flusher), so a slow
+// callback delays that caller.
+func (dh *DataDogHook) reportError(err error, entry *logrus.Entry) {
+	if dh.onError != nil {
+		dh.onError(err, entry)
+	}
+}
+
+// Stats returns a snapshot of the hook's delivery counters.
+func (dh *DataDogHook) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadUint64(&dh.sent),
+		Dropped: atomic.LoadUint64(&dh.dropped),
+		Failed:  atomic.LoadUint64(&dh.failed),
+		Retried: atomic.LoadUint64(&dh.retried),
+	}
+}
+
+// Close drains and flushes any pending logs, then stops the background
+// flusher. It is meant to be wired into logrus.DeferExitHandler (or called
+// directly on shutdown) so buffered entries aren't lost on exit.
+func (dh *DataDogHook) Close() error {
+	dh.closeOnce.Do(func() {
+		close(dh.done)
+	})
+	dh.wg.Wait()
+	return nil
+}
+
+// loop accumulates formatted entries and flushes them as a batch whenever
+// BatchMaxSize/BatchMaxBytes is reached, FlushInterval elapses, or Close is
+// called.
+func (dh *DataDogHook) loop() {
+	defer dh.wg.Done()
+
+	ticker := time.NewTicker(dh.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, dh.batchMaxSize)
+	batchBytes := 0
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// send accounts sent/failed/dropped and invokes OnError itself for
+		// every outcome, including a marshalBatch failure, so there's
+		// nothing left for flush to do with the returned error.
+		dh.send(batch)
+		batch = make([][]byte, 0, dh.batchMaxSize)
+		batchBytes = 0
+	}
+
+	for {
+		select {
+		case log := <-dh.buffer:
+			batch = append(batch, log)
+			batchBytes += len(log)
+			if len(batch) >= dh.batchMaxSize || batchBytes >= dh.batchMaxBytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-dh.done:
+			for {
+				select {
+				case log := <-dh.buffer:
+					batch = append(batch, log)
+					batchBytes += len(log)
+					if len(batch) >= dh.batchMaxSize || batchBytes >= dh.batchMaxBytes {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts a batch of already-formatted entries to DataDog as a single
+// JSON array, as documented for the HTTP log intake.
+func (dh *DataDogHook) send(batch [][]byte) error {
+	body, included, err := marshalBatch(batch)
+	if err != nil {
+		dh.failBatch(len(batch), err)
+		return err
+	}
+
+	if truncated := len(batch) - included; truncated > 0 {
+		atomic.AddUint64(&dh.dropped, uint64(truncated))
+		dh.reportError(fmt.Errorf("datadog hook: dropped %d entries exceeding the %d-entry/%d-byte DataDog intake limits", truncated, maxBatchSize, maxBatchBytes), nil)
+	}
+
+	gzipped := false
+	if len(body) > gzipThreshold {
+		compressed, err := gzipCompress(body)
+		if err != nil {
+			dh.failBatch(included, err)
+			return err
+		}
+		body = compressed
+		gzipped = true
 	}
 
 	i := 0
 	for {
-		req, err := http.NewRequest("POST", dh.URL.String(), bytes.NewBuffer(log))
+		req, err := http.NewRequest("POST", dh.URL.String(), bytes.NewBuffer(body))
 		if err != nil {
+			dh.failBatch(included, err)
 			return err
 		}
 
 		req.Header.Add(apiKeyHeader, dh.APIKey)
 		req.Header.Add("Content-Type", contentType)
-		resp, err := http.DefaultClient.Do(req)
+		if gzipped {
+			req.Header.Add("Content-Encoding", "gzip")
+		}
+		resp, err := dh.HTTPClient.Do(req)
 		if err != nil {
-			return err
+			if i >= maxRetry {
+				dh.failBatch(included, err)
+				return err
+			}
+			i++
+			atomic.AddUint64(&dh.retried, 1)
+			time.Sleep(backoffDelay(i))
+			continue
 		}
-		defer resp.Body.Close()
+
 		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			resp.Body.Close()
+			atomic.AddUint64(&dh.sent, uint64(included))
 			return nil
 		}
-		if i >= maxRetry {
-			body, _ := ioutil.ReadAll(resp.Body)
-			return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, body)
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		resp.Body.Close()
+
+		if !isRetriableStatus(resp.StatusCode) || i >= maxRetry {
+			err := fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, respBody)
+			dh.failBatch(included, err)
+			return err
 		}
+
 		i++
-		time.Sleep(time.Second)
+		atomic.AddUint64(&dh.retried, 1)
+		if hasRetryAfter {
+			time.Sleep(clampDelay(retryAfter))
+		} else {
+			time.Sleep(backoffDelay(i))
+		}
+	}
+}
+
+// failBatch accounts count entries as failed and reports err through
+// OnError. entry is nil since a batch mixes entries from possibly many Fire
+// calls.
+func (dh *DataDogHook) failBatch(count int, err error) {
+	atomic.AddUint64(&dh.failed, uint64(count))
+	dh.reportError(err, nil)
+}
+
+// isRetriableStatus reports whether a response status code is worth
+// retrying: DataDog rate-limiting (429), request timeout (408), and server
+// errors (5xx). Other 4xx codes indicate a permanent problem with the
+// request (bad API key, malformed payload, ...) and are not retried.
+func isRetriableStatus(statusCode int) bool {
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout {
+		return true
+	}
+	return statusCode >= 500
+}
+
+// backoffDelay returns the exponential backoff delay, with full jitter, to
+// wait before retry attempt n (1-indexed).
+func backoffDelay(attempt int) time.Duration {
+	delay := float64(retryBaseDelay) * math.Pow(retryFactor, float64(attempt-1))
+	if delay > float64(retryMaxDelay) {
+		delay = float64(retryMaxDelay)
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// clampDelay caps d at retryMaxDelay, so a DataDog Retry-After header can't
+// stall a retry loop longer than the exponential backoff cap.
+func clampDelay(d time.Duration) time.Duration {
+	if d > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return d
+}
+
+// parseRetryAfter parses a Retry-After header value, which DataDog sends as
+// a number of seconds on 429/503 responses.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// marshalBatch assembles a batch of pre-formatted JSON entries into a single
+// JSON array, trimming it down to the 1000-entry/5MB DataDog intake limits
+// if the configured batch options allowed it to grow past them. It returns
+// the number of entries actually included, which callers must use for
+// sent/dropped accounting instead of len(batch): entries beyond the limits
+// are left out of the request entirely.
+func marshalBatch(batch [][]byte) ([]byte, int, error) {
+	if len(batch) > maxBatchSize {
+		batch = batch[:maxBatchSize]
+	}
+
+	raw := make([]json.RawMessage, 0, len(batch))
+	size := 2 // "[]"
+	for _, log := range batch {
+		if size+len(log)+1 > maxBatchBytes {
+			break
+		}
+		raw = append(raw, log)
+		size += len(log) + 1
+	}
+
+	body, err := json.Marshal(raw)
+	return body, len(raw), err
+}
+
+// traceFieldKeys maps the logrus field a caller sets to the DataDog
+// attribute it's translated to, so APM trace/log correlation works out of
+// the box when a tracer has injected trace_id/span_id into the entry.
+var traceFieldKeys = map[string]string{
+	"trace_id": "dd.trace_id",
+	"span_id":  "dd.span_id",
+}
+
+// dataDogFormatter wraps logrus.JSONFormatter to remap fields onto the
+// names DataDog's log explorer expects, and to inject global tags and
+// attributes into every entry.
+type dataDogFormatter struct {
+	inner            logrus.Formatter
+	ddtags           string
+	globalAttributes map[string]interface{}
+}
+
+func newDataDogFormatter(tags map[string]string, attributes map[string]interface{}) *dataDogFormatter {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, fmt.Sprintf("%s:%s", k, v))
+	}
+	sort.Strings(pairs)
+
+	return &dataDogFormatter{
+		inner: &logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyMsg:   "message",
+				logrus.FieldKeyLevel: "status",
+			},
+		},
+		ddtags:           strings.Join(pairs, ","),
+		globalAttributes: attributes,
+	}
+}
+
+func (f *dataDogFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	formatted, err := f.inner.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(formatted))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	for k, v := range f.globalAttributes {
+		if _, exists := fields[k]; !exists {
+			fields[k] = v
+		}
+	}
+
+	if f.ddtags != "" {
+		fields["ddtags"] = f.ddtags
+	}
+
+	for entryKey, ddKey := range traceFieldKeys {
+		if v, ok := entry.Data[entryKey]; ok {
+			fields[ddKey] = v
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+// gzipCompress compresses body, which DataDog's HTTP intake accepts via
+// Content-Encoding: gzip and which considerably cuts egress for JSON logs.
+func gzipCompress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
 	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildHTTPClient returns options.HTTPClient as-is if set, otherwise builds
+// a client that respects options.Proxy/TLSConfig/Timeout and is tuned to be
+// reused across many requests to the same DataDog intake host.
+func buildHTTPClient(options DataDogOptions) (*http.Client, error) {
+	if options.HTTPClient != nil {
+		return options.HTTPClient, nil
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout: options.Timeout,
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			TLSClientConfig:     options.TLSConfig,
+			MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		},
+	}, nil
 }
 
 func buildURL(baseURL, basePath, service, source, host string) (*url.URL, error) {
@@ -141,10 +650,34 @@ func setDefaults(options *DataDogOptions) {
 	if options.MinLevel == 0 {
 		options.MinLevel = defaultMinLevel
 	}
+	if options.Site == "" {
+		options.Site = defaultSite
+	}
 	if options.BaseURL == "" {
-		options.BaseURL = defaultBaseURL
+		options.BaseURL = "https://http-intake.logs." + string(options.Site)
 	}
 	if options.BasePath == "" {
 		options.BasePath = defaultBasePath
 	}
+	if options.BatchMaxSize == 0 {
+		options.BatchMaxSize = defaultBatchMaxSize
+	}
+	if options.BatchMaxSize > maxBatchSize {
+		options.BatchMaxSize = maxBatchSize
+	}
+	if options.BatchMaxBytes == 0 {
+		options.BatchMaxBytes = defaultBatchMaxBytes
+	}
+	if options.BatchMaxBytes > maxBatchBytes {
+		options.BatchMaxBytes = maxBatchBytes
+	}
+	if options.FlushInterval == 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	if options.BufferSize == 0 {
+		options.BufferSize = defaultBufferSize
+	}
+	if options.Timeout == 0 {
+		options.Timeout = defaultTimeout
+	}
 }
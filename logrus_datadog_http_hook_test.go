@@ -0,0 +1,632 @@
+package hook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stubFormatter formats every entry as a tiny, fixed-size JSON object so
+// tests can control batch size/byte accounting precisely.
+type stubFormatter struct {
+	body []byte
+}
+
+func (f stubFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if f.body != nil {
+		return f.body, nil
+	}
+	return []byte(`{"msg":"x"}`), nil
+}
+
+func newTestEntry() *logrus.Entry {
+	return logrus.NewEntry(logrus.New())
+}
+
+func TestMarshalBatch_ClampsToEntryCountLimit(t *testing.T) {
+	batch := make([][]byte, maxBatchSize+5)
+	for i := range batch {
+		batch[i] = []byte(`{}`)
+	}
+
+	body, included, err := marshalBatch(batch)
+	if err != nil {
+		t.Fatalf("marshalBatch returned error: %v", err)
+	}
+	if included != maxBatchSize {
+		t.Fatalf("included = %d, want %d", included, maxBatchSize)
+	}
+
+	var decoded []json.RawMessage
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("marshalBatch produced invalid JSON: %v", err)
+	}
+	if len(decoded) != maxBatchSize {
+		t.Fatalf("len(decoded) = %d, want %d", len(decoded), maxBatchSize)
+	}
+}
+
+func TestMarshalBatch_ClampsToByteSizeLimit(t *testing.T) {
+	// Entries large enough that the byte limit binds before the
+	// maxBatchSize entry-count limit does.
+	entry := bytes.Repeat([]byte("a"), 8*1024)
+	entryJSON, _ := json.Marshal(string(entry))
+
+	batchLen := maxBatchBytes/len(entryJSON) + 10
+	batch := make([][]byte, batchLen)
+	for i := range batch {
+		batch[i] = entryJSON
+	}
+
+	body, included, err := marshalBatch(batch)
+	if err != nil {
+		t.Fatalf("marshalBatch returned error: %v", err)
+	}
+	if included >= batchLen {
+		t.Fatalf("included = %d, want fewer than %d entries", included, batchLen)
+	}
+	if len(body) > maxBatchBytes {
+		t.Fatalf("len(body) = %d, exceeds maxBatchBytes %d", len(body), maxBatchBytes)
+	}
+}
+
+func TestLoop_FlushesOnBatchMaxSize(t *testing.T) {
+	received := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries []json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&entries)
+		received <- len(entries)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	hook, err := NewDataDogHook(DataDogOptions{
+		APIKey:        "key",
+		BaseURL:       server.URL,
+		BatchMaxSize:  2,
+		FlushInterval: time.Hour,
+		BufferSize:    10,
+	})
+	if err != nil {
+		t.Fatalf("NewDataDogHook returned error: %v", err)
+	}
+	hook.Formatter = stubFormatter{}
+	defer hook.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := hook.Fire(newTestEntry()); err != nil {
+			t.Fatalf("Fire returned error: %v", err)
+		}
+	}
+
+	select {
+	case n := <-received:
+		if n != 2 {
+			t.Fatalf("batch size = %d, want 2", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for batch flush on BatchMaxSize")
+	}
+}
+
+func TestLoop_FlushesOnTicker(t *testing.T) {
+	received := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries []json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&entries)
+		received <- len(entries)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	hook, err := NewDataDogHook(DataDogOptions{
+		APIKey:        "key",
+		BaseURL:       server.URL,
+		BatchMaxSize:  100,
+		FlushInterval: 20 * time.Millisecond,
+		BufferSize:    10,
+	})
+	if err != nil {
+		t.Fatalf("NewDataDogHook returned error: %v", err)
+	}
+	hook.Formatter = stubFormatter{}
+	defer hook.Close()
+
+	if err := hook.Fire(newTestEntry()); err != nil {
+		t.Fatalf("Fire returned error: %v", err)
+	}
+
+	select {
+	case n := <-received:
+		if n != 1 {
+			t.Fatalf("batch size = %d, want 1", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for batch flush on FlushInterval")
+	}
+}
+
+func TestClose_DrainsPendingEntries(t *testing.T) {
+	received := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries []json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&entries)
+		received <- len(entries)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	hook, err := NewDataDogHook(DataDogOptions{
+		APIKey:        "key",
+		BaseURL:       server.URL,
+		BatchMaxSize:  100,
+		FlushInterval: time.Hour,
+		BufferSize:    10,
+	})
+	if err != nil {
+		t.Fatalf("NewDataDogHook returned error: %v", err)
+	}
+	hook.Formatter = stubFormatter{}
+
+	for i := 0; i < 5; i++ {
+		if err := hook.Fire(newTestEntry()); err != nil {
+			t.Fatalf("Fire returned error: %v", err)
+		}
+	}
+
+	if err := hook.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	select {
+	case n := <-received:
+		if n != 5 {
+			t.Fatalf("batch size = %d, want 5", n)
+		}
+	default:
+		t.Fatal("Close returned before draining pending entries")
+	}
+}
+
+func TestFire_OverflowDropNewestDropsTheIncomingEntry(t *testing.T) {
+	hook := &DataDogHook{
+		Formatter:      stubFormatter{},
+		overflowPolicy: OverflowDropNewest,
+		buffer:         make(chan []byte, 1),
+	}
+	hook.buffer <- []byte(`{"kept":true}`)
+
+	err := hook.Fire(newTestEntry())
+	if err != ErrBufferFull {
+		t.Fatalf("err = %v, want ErrBufferFull", err)
+	}
+	if got := hook.Stats().Dropped; got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+	if got := <-hook.buffer; string(got) != `{"kept":true}` {
+		t.Fatalf("buffer content = %s, want original entry preserved", got)
+	}
+}
+
+func TestFire_OverflowDropOldestEvictsTheBufferedEntry(t *testing.T) {
+	hook := &DataDogHook{
+		Formatter:      stubFormatter{body: []byte(`{"new":true}`)},
+		overflowPolicy: OverflowDropOldest,
+		buffer:         make(chan []byte, 1),
+	}
+	hook.buffer <- []byte(`{"old":true}`)
+
+	if err := hook.Fire(newTestEntry()); err != nil {
+		t.Fatalf("Fire returned error: %v", err)
+	}
+	if got := hook.Stats().Dropped; got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+	if got := <-hook.buffer; string(got) != `{"new":true}` {
+		t.Fatalf("buffer content = %s, want the new entry to have replaced the old one", got)
+	}
+}
+
+func TestFire_OverflowBlockWaitsForRoom(t *testing.T) {
+	hook := &DataDogHook{
+		Formatter:      stubFormatter{},
+		overflowPolicy: OverflowBlock,
+		buffer:         make(chan []byte, 1),
+	}
+	hook.buffer <- []byte(`{"first":true}`)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hook.Fire(newTestEntry())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Fire returned before the buffer had room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-hook.buffer // make room
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Fire returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Fire did not unblock after the buffer had room")
+	}
+	if got := hook.Stats().Dropped; got != 0 {
+		t.Fatalf("Dropped = %d, want 0", got)
+	}
+}
+
+func TestDataDogFormatter_MergesTagsAndAttributes(t *testing.T) {
+	f := newDataDogFormatter(
+		map[string]string{"env": "prod", "team": "infra"},
+		map[string]interface{}{"service": "svc", "region": "eu"},
+	)
+
+	entry := newTestEntry()
+	entry.Data = logrus.Fields{"region": "us"}
+	entry.Message = "hello"
+
+	out, err := f.Format(entry)
+	if err != nil {
+		t.Fatalf("Format returned error: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatalf("Format produced invalid JSON: %v", err)
+	}
+
+	if got := fields["ddtags"]; got != "env:prod,team:infra" {
+		t.Fatalf("ddtags = %v, want \"env:prod,team:infra\"", got)
+	}
+	if got := fields["service"]; got != "svc" {
+		t.Fatalf("service = %v, want \"svc\" (global attribute)", got)
+	}
+	if got := fields["region"]; got != "us" {
+		t.Fatalf("region = %v, want \"us\" (entry field must win over global attribute)", got)
+	}
+}
+
+func TestDataDogFormatter_RemapsMessageAndLevel(t *testing.T) {
+	f := newDataDogFormatter(nil, nil)
+
+	entry := newTestEntry()
+	entry.Message = "hello world"
+	entry.Level = logrus.InfoLevel
+
+	out, err := f.Format(entry)
+	if err != nil {
+		t.Fatalf("Format returned error: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatalf("Format produced invalid JSON: %v", err)
+	}
+
+	if got := fields["message"]; got != "hello world" {
+		t.Fatalf("message = %v, want \"hello world\"", got)
+	}
+	if got := fields["status"]; got != "info" {
+		t.Fatalf("status = %v, want \"info\"", got)
+	}
+	if _, ok := fields["msg"]; ok {
+		t.Fatal("output still has the raw \"msg\" key, want it remapped to \"message\"")
+	}
+	if _, ok := fields["level"]; ok {
+		t.Fatal("output still has the raw \"level\" key, want it remapped to \"status\"")
+	}
+}
+
+func TestDataDogFormatter_PropagatesTraceAndSpanID(t *testing.T) {
+	f := newDataDogFormatter(nil, nil)
+
+	entry := newTestEntry()
+	entry.Data = logrus.Fields{"trace_id": "trace-123", "span_id": "span-456"}
+
+	out, err := f.Format(entry)
+	if err != nil {
+		t.Fatalf("Format returned error: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatalf("Format produced invalid JSON: %v", err)
+	}
+
+	if got := fields["dd.trace_id"]; got != "trace-123" {
+		t.Fatalf("dd.trace_id = %v, want \"trace-123\"", got)
+	}
+	if got := fields["dd.span_id"]; got != "span-456" {
+		t.Fatalf("dd.span_id = %v, want \"span-456\"", got)
+	}
+}
+
+func TestDataDogFormatter_PreservesLargeIntegers(t *testing.T) {
+	f := newDataDogFormatter(nil, nil)
+
+	entry := newTestEntry()
+	entry.Data = logrus.Fields{"big_id": int64(9007199254740993)}
+
+	out, err := f.Format(entry)
+	if err != nil {
+		t.Fatalf("Format returned error: %v", err)
+	}
+
+	if !bytes.Contains(out, []byte(`"big_id":9007199254740993`)) {
+		t.Fatalf("output lost precision on a large integer field: %s", out)
+	}
+}
+
+func TestBuildHTTPClient_ReturnsProvidedClientAsIs(t *testing.T) {
+	custom := &http.Client{Timeout: 42 * time.Second}
+
+	client, err := buildHTTPClient(DataDogOptions{HTTPClient: custom})
+	if err != nil {
+		t.Fatalf("buildHTTPClient returned error: %v", err)
+	}
+	if client != custom {
+		t.Fatal("buildHTTPClient did not return the provided HTTPClient as-is")
+	}
+}
+
+func TestBuildHTTPClient_AppliesTimeoutAndDefaultConnectionTuning(t *testing.T) {
+	client, err := buildHTTPClient(DataDogOptions{Timeout: 7 * time.Second})
+	if err != nil {
+		t.Fatalf("buildHTTPClient returned error: %v", err)
+	}
+	if client.Timeout != 7*time.Second {
+		t.Fatalf("Timeout = %v, want 7s", client.Timeout)
+	}
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Transport = %T, want *http.Transport", client.Transport)
+	}
+	if transport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Fatalf("MaxIdleConnsPerHost = %d, want %d", transport.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	}
+	if transport.Proxy == nil {
+		t.Fatal("Proxy func is nil, want http.ProxyFromEnvironment by default")
+	}
+}
+
+func TestBuildHTTPClient_ConfiguresExplicitProxy(t *testing.T) {
+	client, err := buildHTTPClient(DataDogOptions{Proxy: "http://proxy.example.com:8080"})
+	if err != nil {
+		t.Fatalf("buildHTTPClient returned error: %v", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	req, _ := http.NewRequest("POST", "https://http-intake.logs.datadoghq.com/v1/input", nil)
+	proxyURL, err := transport.Proxy(req)
+	if err != nil {
+		t.Fatalf("Proxy func returned error: %v", err)
+	}
+	if proxyURL == nil || proxyURL.String() != "http://proxy.example.com:8080" {
+		t.Fatalf("proxyURL = %v, want http://proxy.example.com:8080", proxyURL)
+	}
+}
+
+func TestBuildHTTPClient_InvalidProxyReturnsError(t *testing.T) {
+	if _, err := buildHTTPClient(DataDogOptions{Proxy: "://not-a-url"}); err == nil {
+		t.Fatal("buildHTTPClient did not return an error for an invalid Proxy URL")
+	}
+}
+
+func TestSetDefaults_ResolvesBaseURLPerSite(t *testing.T) {
+	cases := []struct {
+		site Site
+		want string
+	}{
+		{SiteUS1, "https://http-intake.logs.datadoghq.com"},
+		{SiteUS3, "https://http-intake.logs.us3.datadoghq.com"},
+		{SiteUS5, "https://http-intake.logs.us5.datadoghq.com"},
+		{SiteEU, "https://http-intake.logs.datadoghq.eu"},
+		{SiteGov, "https://http-intake.logs.ddog-gov.com"},
+		{"", "https://http-intake.logs.datadoghq.eu"}, // default site
+	}
+
+	for _, c := range cases {
+		opts := DataDogOptions{Site: c.site}
+		setDefaults(&opts)
+		if opts.BaseURL != c.want {
+			t.Errorf("Site %q: BaseURL = %q, want %q", c.site, opts.BaseURL, c.want)
+		}
+	}
+}
+
+func TestSetDefaults_ExplicitBaseURLOverridesSite(t *testing.T) {
+	opts := DataDogOptions{Site: SiteUS1, BaseURL: "https://custom.example.com"}
+	setDefaults(&opts)
+	if opts.BaseURL != "https://custom.example.com" {
+		t.Fatalf("BaseURL = %q, want explicit value to take precedence over Site", opts.BaseURL)
+	}
+}
+
+func TestGzipCompress_ProducesADecodableGzipStream(t *testing.T) {
+	original := []byte(`{"hello":"world"}`)
+
+	compressed, err := gzipCompress(original)
+	if err != nil {
+		t.Fatalf("gzipCompress returned error: %v", err)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("gzip.NewReader returned error: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading decompressed stream returned error: %v", err)
+	}
+	if !bytes.Equal(decompressed, original) {
+		t.Fatalf("decompressed = %s, want %s", decompressed, original)
+	}
+}
+
+func TestSend_CompressesPayloadsOverGzipThreshold(t *testing.T) {
+	var gotEncoding string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		body, _ := ioutil.ReadAll(r.Body)
+		if gotEncoding == "gzip" {
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("server could not gunzip request body: %v", err)
+			}
+			body, _ = ioutil.ReadAll(gz)
+		}
+		gotBody = body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	largeEntry, _ := json.Marshal(strings.Repeat("a", gzipThreshold+1))
+	dh := newTestHook(t, server.URL)
+
+	if err := dh.send([][]byte{largeEntry}); err != nil {
+		t.Fatalf("send returned error: %v", err)
+	}
+	if gotEncoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want \"gzip\" for a payload over the threshold", gotEncoding)
+	}
+	if !bytes.Contains(gotBody, largeEntry) {
+		t.Fatalf("decompressed body = %s, want it to contain %s", gotBody, largeEntry)
+	}
+}
+
+func TestSend_DoesNotCompressSmallPayloads(t *testing.T) {
+	var gotEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dh := newTestHook(t, server.URL)
+
+	if err := dh.send([][]byte{[]byte(`"x"`)}); err != nil {
+		t.Fatalf("send returned error: %v", err)
+	}
+	if gotEncoding != "" {
+		t.Fatalf("Content-Encoding = %q, want none for a payload under the threshold", gotEncoding)
+	}
+}
+
+// newTestHook builds a minimal DataDogHook that posts to baseURL, for tests
+// that exercise send() directly without going through the background loop.
+func newTestHook(t *testing.T, baseURL string) *DataDogHook {
+	t.Helper()
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		t.Fatalf("url.Parse returned error: %v", err)
+	}
+	return &DataDogHook{
+		APIKey:     "key",
+		URL:        parsed,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func TestIsRetriableStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusTooManyRequests, true},
+		{http.StatusRequestTimeout, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+	}
+
+	for _, c := range cases {
+		if got := isRetriableStatus(c.status); got != c.want {
+			t.Errorf("isRetriableStatus(%d) = %v, want %v", c.status, got, c.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := []struct {
+		header    string
+		wantDelay time.Duration
+		wantOK    bool
+	}{
+		{"120", 120 * time.Second, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"not-a-number", 0, false},
+	}
+
+	for _, c := range cases {
+		delay, ok := parseRetryAfter(c.header)
+		if ok != c.wantOK || delay != c.wantDelay {
+			t.Errorf("parseRetryAfter(%q) = (%v, %v), want (%v, %v)", c.header, delay, ok, c.wantDelay, c.wantOK)
+		}
+	}
+}
+
+func TestBackoffDelay_NeverExceedsCapOrExpectedGrowth(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		uncappedMax := float64(retryBaseDelay) * math.Pow(retryFactor, float64(attempt-1))
+		wantMax := time.Duration(uncappedMax)
+		if wantMax > retryMaxDelay {
+			wantMax = retryMaxDelay
+		}
+
+		for i := 0; i < 20; i++ {
+			delay := backoffDelay(attempt)
+			if delay < 0 || delay > wantMax {
+				t.Fatalf("backoffDelay(%d) = %v, want in [0, %v]", attempt, delay, wantMax)
+			}
+		}
+	}
+}
+
+func TestBackoffDelay_CapsAtRetryMaxDelay(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		if delay := backoffDelay(30); delay > retryMaxDelay {
+			t.Fatalf("backoffDelay(30) = %v, want <= retryMaxDelay (%v)", delay, retryMaxDelay)
+		}
+	}
+}
+
+func TestClampDelay(t *testing.T) {
+	cases := []struct {
+		d    time.Duration
+		want time.Duration
+	}{
+		{time.Second, time.Second},
+		{retryMaxDelay, retryMaxDelay},
+		{retryMaxDelay + time.Second, retryMaxDelay},
+		{time.Hour, retryMaxDelay},
+	}
+
+	for _, c := range cases {
+		if got := clampDelay(c.d); got != c.want {
+			t.Errorf("clampDelay(%v) = %v, want %v", c.d, got, c.want)
+		}
+	}
+}